@@ -2,23 +2,46 @@ package deploy
 
 import (
 	"archive/zip"
-	"bytes"
+	"crypto/md5"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
-	"strings"
+	"time"
+
+	"github.com/bmatcuk/doublestar/v4"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/elasticbeanstalk"
 	"github.com/aws/aws-sdk-go/service/s3"
 )
 
+// Default multipart upload tuning, used when UploadOptions leaves a field
+// at its zero value.
+const (
+	defaultUploadPartSize    = 5 * 1024 * 1024 // S3 minimum part size
+	defaultUploadConcurrency = 5
+)
+
+/*
+ *
+ *	UploadOptions controls the s3manager multipart uploader used by
+ *	S3Storage.
+ *
+ */
+
+type UploadOptions struct {
+	PartSize          int64 `json:"partSize"`
+	Concurrency       int   `json:"concurrency"`
+	LeavePartsOnError bool  `json:"leavePartsOnError"`
+}
+
 /*
  *
  *	_progressFunc is the type of the function called for each archive file.
@@ -49,12 +72,22 @@ type _deploymentDescriptor struct {
 			EnvironmentName string `json:"environmentName"`
 		} `json:"elb"`
 	} `json:"aws"`
-	Branch       string           `json:"branch"`
-	BuildVersion string           `json:"-"`
-	BuildKey     string           `json:"-"`
-	Directory    string           `json:"-"`
-	CommitHash   string           `json:"-"`
-	Session      *session.Session `json:"-"`
+	Branch               string           `json:"branch"`
+	VersionTemplate      string           `json:"versionTemplate"`
+	Upload               UploadOptions    `json:"upload"`
+	Storage              StorageConfig    `json:"storage"`
+	ForceRepublish       bool             `json:"forceRepublish"`
+	Hooks                Hooks            `json:"hooks"`
+	DeployTimeoutSeconds int              `json:"deployTimeoutSeconds"`
+	BuildVersion         string           `json:"-"`
+	BuildKey             string           `json:"-"`
+	Directory            string           `json:"-"`
+	CommitHash           string           `json:"-"`
+	Session              *session.Session `json:"-"`
+	DeployTimeout        time.Duration    `json:"-"`
+	EventHandler         EventHandler     `json:"-"`
+	resolvedS3Bucket     string           `json:"-"`
+	storedInS3           bool             `json:"-"`
 }
 
 /*
@@ -80,14 +113,25 @@ func newDeploymentDescriptor(deploymentDirectory string) (*_deploymentDescriptor
 
 	descriptor.Directory = deploymentDirectory
 
-	commitHash, err := descriptor.getCommitHash()
+	gitInfo, err := descriptor.resolveGitInfo()
 	if err != nil {
 		return nil, err
 	}
 
-	descriptor.CommitHash = commitHash
-	descriptor.BuildVersion = fmt.Sprintf("%v-%v", descriptor.Branch, commitHash)
+	buildVersion, err := descriptor.renderBuildVersion(gitInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	descriptor.CommitHash = gitInfo.SHA
+	descriptor.BuildVersion = buildVersion
 	descriptor.BuildKey = descriptor.BuildVersion + ".zip"
+
+	descriptor.DeployTimeout = time.Duration(descriptor.DeployTimeoutSeconds) * time.Second
+	if descriptor.DeployTimeout <= 0 {
+		descriptor.DeployTimeout = defaultDeployTimeout
+	}
+
 	descriptor.Session = session.New(&aws.Config{
 		Credentials: credentials.NewStaticCredentials(
 			descriptor.AWS.Credentials.AccessKey,
@@ -100,37 +144,41 @@ func newDeploymentDescriptor(deploymentDirectory string) (*_deploymentDescriptor
 	return descriptor, nil
 }
 
-/*
- *
- *	Get commit hash from HEAD of branch in deploy.json
- *
- */
-
-func (descriptor *_deploymentDescriptor) getCommitHash() (string, error) {
-	headPath := filepath.Join(descriptor.Directory, ".git", "refs", "heads", descriptor.Branch)
-
-	content, err := ioutil.ReadFile(headPath)
-	if err != nil {
-		return "", err
-	}
-
-	return strings.TrimSpace(string(content)), nil
-}
-
 /*
  *
  *	Create zip
  *
  */
 
-func writeDirToZip(wr *zip.Writer, dirPath string, progress _progressFunc) error {
+func writeDirToZip(wr *zip.Writer, dirPath string, rootDir string, ignore *ignoreMatcher, progress _progressFunc) error {
 	basePath := filepath.Base(dirPath)
 
 	err := filepath.Walk(dirPath, func(filePath string, fileInfo os.FileInfo, err error) error {
-		if err != nil || fileInfo.IsDir() {
+		if err != nil {
 			return err
 		}
 
+		relativeToRoot, err := filepath.Rel(rootDir, filePath)
+		if err != nil {
+			return err
+		}
+
+		if fileInfo.IsDir() {
+			if fileInfo.Name() == ".git" {
+				return filepath.SkipDir
+			}
+
+			if ignore.match(relativeToRoot) {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if ignore.match(relativeToRoot) {
+			return nil
+		}
+
 		relativeFilePath, err := filepath.Rel(dirPath, filePath)
 		if err != nil {
 			return err
@@ -185,93 +233,275 @@ func writeFileToZip(wr *zip.Writer, filePath string, progress _progressFunc) err
 	return err
 }
 
-func (descriptor *_deploymentDescriptor) zipFiles(progress _progressFunc) (*bytes.Buffer, error) {
-	// Create zip buffer
-	zipBuffer := new(bytes.Buffer)
-	zipWriter := zip.NewWriter(zipBuffer)
+func (descriptor *_deploymentDescriptor) writeZip(wr *zip.Writer, progress _progressFunc) error {
 	deployDir := descriptor.Directory
 
-	for _, deployFile := range descriptor.Files {
-		filePath := filepath.Join(deployDir, deployFile)
-		info, err := os.Lstat(filePath)
+	ignore, err := loadIgnoreMatcher(deployDir)
+	if err != nil {
+		return err
+	}
+
+	written := map[string]bool{}
+
+	for _, pattern := range descriptor.Files {
+		relativePaths, err := doublestar.Glob(os.DirFS(deployDir), pattern)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		if info.IsDir() {
-			err = writeDirToZip(zipWriter, filePath, progress)
-		} else {
-			err = writeFileToZip(zipWriter, filePath, progress)
+		if len(relativePaths) == 0 {
+			// Not a glob (or a glob matching nothing yet): fall back to the
+			// literal entry so plain file/directory paths keep working.
+			relativePaths = []string{pattern}
 		}
 
-		if err != nil {
-			return nil, err
+		for _, relativePath := range relativePaths {
+			if written[relativePath] {
+				continue
+			}
+			written[relativePath] = true
+
+			if ignore.match(relativePath) {
+				continue
+			}
+
+			filePath := filepath.Join(deployDir, relativePath)
+			info, err := os.Lstat(filePath)
+			if err != nil {
+				return err
+			}
+
+			if info.IsDir() {
+				err = writeDirToZip(wr, filePath, deployDir, ignore, progress)
+			} else {
+				err = writeFileToZip(wr, filePath, progress)
+			}
+
+			if err != nil {
+				return err
+			}
 		}
 	}
 
-	err := zipWriter.Close()
-	if err != nil {
-		return nil, err
+	return nil
+}
+
+/*
+ *
+ *	setUploadPartContentMD5 hashes the body of every multipart upload part
+ *	(or, for archives small enough that s3manager falls back to a single
+ *	PutObject, the whole body) and attaches it as the Content-MD5 header,
+ *	so S3 rejects a part that got corrupted in transit instead of silently
+ *	accepting it.
+ *
+ */
+
+func setUploadPartContentMD5(r *request.Request) {
+	switch input := r.Params.(type) {
+	case *s3.UploadPartInput:
+		if seeker, ok := input.Body.(io.ReadSeeker); ok {
+			input.ContentMD5 = md5ContentHeader(seeker)
+		}
+	case *s3.PutObjectInput:
+		if seeker, ok := input.Body.(io.ReadSeeker); ok {
+			input.ContentMD5 = md5ContentHeader(seeker)
+		}
+	}
+}
+
+// md5ContentHeader hashes seeker from its current position, then seeks it
+// back to the start and returns the base64-encoded digest for Content-MD5.
+// It assumes seeker is positioned at the start of the body when called,
+// which holds for the s3manager part/put bodies setUploadPartContentMD5
+// handles; it returns nil if seeker can't be hashed or rewound.
+func md5ContentHeader(seeker io.ReadSeeker) *string {
+	hash := md5.New()
+	if _, err := io.Copy(hash, seeker); err != nil {
+		return nil
+	}
+
+	if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+		return nil
 	}
 
-	return zipBuffer, nil
+	return aws.String(base64.StdEncoding.EncodeToString(hash.Sum(nil)))
 }
 
 /*
  *
- *	Create zip and upload to S3
+ *	Stream the zip straight into the configured Storage backend instead of
+ *	buffering the whole archive in memory: writeZip fills one end of an
+ *	io.Pipe while the backend reads off the other end as data becomes
+ *	available. If an object under BuildKey already exists, the upload is
+ *	skipped entirely, so re-running a deploy for a commit already shipped
+ *	is a cheap no-op; ForceRepublish bypasses that check. The skip only
+ *	checks for a non-empty object under BuildKey, not that its contents
+ *	match what this run would produce — see the Storage.Exists doc comment.
+ *	PreZip, PreUpload, PostZip and PostUpload are all tied to that upload
+ *	actually happening, so none of them run on a cache-hit skip — see the
+ *	Hooks doc comment.
  *
  */
-func (descriptor *_deploymentDescriptor) uploadToS3() error {
-	zipBuffer, err := descriptor.zipFiles(nil)
+func (descriptor *_deploymentDescriptor) uploadArchive() error {
+	storage, err := descriptor.newStorage()
 	if err != nil {
 		return err
 	}
 
-	s3client := s3.New(descriptor.Session)
+	if s3Storage, ok := storage.(*S3Storage); ok {
+		descriptor.resolvedS3Bucket = s3Storage.bucket
+		descriptor.storedInS3 = true
+	}
+
+	if !descriptor.ForceRepublish {
+		exists, err := storage.Exists(descriptor.BuildKey)
+		if err != nil {
+			return err
+		}
 
-	params := &s3.PutObjectInput{
-		Bucket:        aws.String(descriptor.AWS.S3.Bucket),
-		Key:           aws.String(descriptor.BuildKey),
-		ACL:           aws.String("private"),
-		Body:          bytes.NewReader(zipBuffer.Bytes()),
-		ContentLength: aws.Int64(int64(zipBuffer.Len())),
-		ContentType:   aws.String("application/zip"),
-		Metadata: map[string]*string{
-			"Key": aws.String("MetadataValue"),
-		},
+		if exists {
+			return nil
+		}
 	}
 
-	_, err = s3client.PutObject(params)
-	if err != nil {
+	if err := descriptor.runHooks(HookPreZip, descriptor.Hooks.PreZip); err != nil {
 		return err
 	}
 
-	return nil
+	pipeReader, pipeWriter := io.Pipe()
+
+	zipDone := make(chan error, 1)
+
+	go func() {
+		zipWriter := zip.NewWriter(pipeWriter)
+
+		err := descriptor.writeZip(zipWriter, nil)
+		if err == nil {
+			err = zipWriter.Close()
+		}
+
+		pipeWriter.CloseWithError(err)
+		zipDone <- err
+	}()
+
+	// abort unblocks the zip goroutine (which may be stuck writing into
+	// pipeWriter) and waits for it to exit, so an early return below never
+	// leaks the goroutine or its pipe.
+	abort := func(cause error) error {
+		_ = pipeReader.CloseWithError(cause)
+		<-zipDone
+		return cause
+	}
+
+	if err := descriptor.runHooks(HookPreUpload, descriptor.Hooks.PreUpload); err != nil {
+		return abort(err)
+	}
+
+	if err := storage.Put(descriptor.BuildKey, pipeReader, -1); err != nil {
+		return abort(err)
+	}
+
+	if zipErr := <-zipDone; zipErr != nil {
+		return zipErr
+	}
+
+	if err := descriptor.runHooks(HookPostZip, descriptor.Hooks.PostZip); err != nil {
+		return err
+	}
+
+	return descriptor.runHooks(HookPostUpload, descriptor.Hooks.PostUpload)
+}
+
+/*
+ *
+ *	applicationVersionExists reports whether an application version
+ *	labelled BuildVersion has already been created, so elasticBeanstalkDeploy
+ *	can skip CreateApplicationVersion and avoid an AlreadyExists error.
+ *
+ */
+
+func (descriptor *_deploymentDescriptor) applicationVersionExists(elbclient *elasticbeanstalk.ElasticBeanstalk) (bool, error) {
+	output, err := elbclient.DescribeApplicationVersions(&elasticbeanstalk.DescribeApplicationVersionsInput{
+		ApplicationName: aws.String(descriptor.AWS.ELB.ApplicationName),
+		VersionLabels:   []*string{aws.String(descriptor.BuildVersion)},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return len(output.ApplicationVersions) > 0, nil
+}
+
+/*
+ *
+ *	currentVersionLabel reports the VersionLabel the environment is running
+ *	right now, so elasticBeanstalkDeploy can roll back to it if the new
+ *	version never becomes healthy.
+ *
+ */
+
+func (descriptor *_deploymentDescriptor) currentVersionLabel(elbclient *elasticbeanstalk.ElasticBeanstalk) (string, error) {
+	output, err := elbclient.DescribeEnvironments(&elasticbeanstalk.DescribeEnvironmentsInput{
+		EnvironmentNames: []*string{aws.String(descriptor.AWS.ELB.EnvironmentName)},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if len(output.Environments) == 0 {
+		return "", nil
+	}
+
+	return aws.StringValue(output.Environments[0].VersionLabel), nil
 }
 
 /*
  *
- *	Deploy to beanstalk, first create application version, then update
- *	environment
+ *	Deploy to beanstalk: create the application version, update the
+ *	environment, then wait for it to leave the Updating state, rolling
+ *	back to the previously-deployed version if it comes up unhealthy.
+ *	Elastic Beanstalk only ever reads an application version's bundle from
+ *	S3, so this requires the "s3" storage driver; with the "local",
+ *	"minio", or "gcs" driver it returns an error without calling Elastic
+ *	Beanstalk.
  *
  */
 func (descriptor *_deploymentDescriptor) elasticBeanstalkDeploy() error {
+	if !descriptor.storedInS3 {
+		driver := descriptor.Storage.Driver
+		if driver == "" {
+			driver = "s3"
+		}
+
+		return fmt.Errorf("storage driver %q cannot source an Elastic Beanstalk application version (it does not upload to S3); use the s3 driver for deployments that call elasticBeanstalkDeploy", driver)
+	}
+
 	// Create elastic beanstalk client
 	elbclient := elasticbeanstalk.New(descriptor.Session)
 
-	// Create application version input
-	versionInput := &elasticbeanstalk.CreateApplicationVersionInput{
-		ApplicationName: aws.String(descriptor.AWS.ELB.ApplicationName),
-		VersionLabel:    aws.String(descriptor.BuildVersion),
-		SourceBundle: &elasticbeanstalk.S3Location{
-			S3Bucket: aws.String(descriptor.AWS.S3.Bucket),
-			S3Key:    aws.String(descriptor.BuildKey),
-		},
+	versionExists, err := descriptor.applicationVersionExists(elbclient)
+	if err != nil {
+		return err
+	}
+
+	if !versionExists || descriptor.ForceRepublish {
+		// Create application version input
+		versionInput := &elasticbeanstalk.CreateApplicationVersionInput{
+			ApplicationName: aws.String(descriptor.AWS.ELB.ApplicationName),
+			VersionLabel:    aws.String(descriptor.BuildVersion),
+			SourceBundle: &elasticbeanstalk.S3Location{
+				S3Bucket: aws.String(descriptor.resolvedS3Bucket),
+				S3Key:    aws.String(descriptor.BuildKey),
+			},
+		}
+
+		// Create application version
+		if _, err := elbclient.CreateApplicationVersion(versionInput); err != nil {
+			return err
+		}
 	}
 
-	// Create application version
-	_, err := elbclient.CreateApplicationVersion(versionInput)
+	previousVersion, err := descriptor.currentVersionLabel(elbclient)
 	if err != nil {
 		return err
 	}
@@ -283,12 +513,11 @@ func (descriptor *_deploymentDescriptor) elasticBeanstalkDeploy() error {
 	}
 
 	// Update environment
-	_, err = elbclient.UpdateEnvironment(environmentInput)
-	if err != nil {
+	if _, err := elbclient.UpdateEnvironment(environmentInput); err != nil {
 		return err
 	}
 
-	return nil
+	return descriptor.waitForEnvironmentReady(elbclient, previousVersion)
 }
 
 // Deploy Docker zip automatically to Elastic Beanstalk with input from deploy.json:
@@ -302,15 +531,36 @@ func Deploy(deploymentDirectory string) error {
 		return err
 	}
 
-	err = desc.uploadToS3()
+	return desc.deploy()
+}
+
+// DeployWithHooks is Deploy plus Go callback hooks for library callers that
+// would rather not shell out to deploy.json's "hooks" commands. hooks maps
+// each HookPoint to the callbacks to run there, alongside any shell commands
+// deploy.json declares for the same point.
+func DeployWithHooks(deploymentDirectory string, hooks map[HookPoint][]HookFunc) error {
+	desc, err := newDeploymentDescriptor(deploymentDirectory)
 	if err != nil {
 		return err
 	}
 
-	err = desc.elasticBeanstalkDeploy()
-	if err != nil {
-		return err
+	desc.Hooks.Func = hooks
+
+	return desc.deploy()
+}
+
+func (descriptor *_deploymentDescriptor) deploy() error {
+	if err := descriptor.uploadArchive(); err != nil {
+		return descriptor.runFailureHook(err)
 	}
 
-	return nil
+	if err := descriptor.runHooks(HookPreDeploy, descriptor.Hooks.PreDeploy); err != nil {
+		return descriptor.runFailureHook(err)
+	}
+
+	if err := descriptor.elasticBeanstalkDeploy(); err != nil {
+		return descriptor.runFailureHook(err)
+	}
+
+	return descriptor.runHooks(HookPostDeploy, descriptor.Hooks.PostDeploy)
 }
@@ -0,0 +1,109 @@
+package deploy
+
+import (
+	"bytes"
+	"text/template"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// defaultVersionTemplate keeps the historical "<branch>-<sha>" BuildVersion
+// shape for deploy.json files that don't set versionTemplate.
+const defaultVersionTemplate = "{{.Branch}}-{{.SHA}}"
+
+/*
+ *
+ *	gitInfo carries the repository state a BuildVersion is rendered from.
+ *
+ */
+
+type gitInfo struct {
+	Branch    string
+	SHA       string
+	ShortSHA  string
+	Timestamp string
+	Author    string
+}
+
+/*
+ *
+ *	resolveGitInfo opens the deployment directory as a git repository and
+ *	resolves descriptor.Branch to its current commit, falling back to HEAD
+ *	when Branch is empty. Using go-git instead of reading refs/heads by
+ *	hand means packed-refs and detached HEADs resolve correctly; opening
+ *	with DetectDotGit/EnableDotGitCommonDir also handles linked worktrees
+ *	(where .git is a file, not a directory) and deploy directories nested
+ *	below the repository root.
+ *
+ */
+
+func (descriptor *_deploymentDescriptor) resolveGitInfo() (*gitInfo, error) {
+	repo, err := git.PlainOpenWithOptions(descriptor.Directory, &git.PlainOpenOptions{
+		DetectDotGit:          true,
+		EnableDotGitCommonDir: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var ref *plumbing.Reference
+	if descriptor.Branch != "" {
+		ref, err = repo.Reference(plumbing.NewBranchReferenceName(descriptor.Branch), true)
+	} else {
+		ref, err = repo.Head()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	commit, err := repo.CommitObject(ref.Hash())
+	if err != nil {
+		return nil, err
+	}
+
+	branch := descriptor.Branch
+	if branch == "" {
+		branch = ref.Name().Short()
+	}
+
+	sha := commit.Hash.String()
+	shortSHA := sha
+	if len(shortSHA) > 7 {
+		shortSHA = shortSHA[:7]
+	}
+
+	return &gitInfo{
+		Branch:    branch,
+		SHA:       sha,
+		ShortSHA:  shortSHA,
+		Timestamp: commit.Author.When.UTC().Format("20060102150405"),
+		Author:    commit.Author.Name,
+	}, nil
+}
+
+/*
+ *
+ *	renderBuildVersion formats gitInfo through descriptor.VersionTemplate
+ *	(or defaultVersionTemplate when it's empty) to produce BuildVersion.
+ *
+ */
+
+func (descriptor *_deploymentDescriptor) renderBuildVersion(info *gitInfo) (string, error) {
+	templateText := descriptor.VersionTemplate
+	if templateText == "" {
+		templateText = defaultVersionTemplate
+	}
+
+	tmpl, err := template.New("buildVersion").Parse(templateText)
+	if err != nil {
+		return "", err
+	}
+
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, info); err != nil {
+		return "", err
+	}
+
+	return rendered.String(), nil
+}
@@ -0,0 +1,121 @@
+package deploy
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+/*
+ *
+ *	HookPoint names a point in the deploy pipeline a hook can attach to.
+ *
+ */
+
+type HookPoint string
+
+const (
+	HookPreZip     HookPoint = "preZip"
+	HookPostZip    HookPoint = "postZip"
+	HookPreUpload  HookPoint = "preUpload"
+	HookPostUpload HookPoint = "postUpload"
+	HookPreDeploy  HookPoint = "preDeploy"
+	HookPostDeploy HookPoint = "postDeploy"
+	HookOnFailure  HookPoint = "onFailure"
+)
+
+// HookFunc is a Go callback hook, for library callers that would rather not
+// shell out. It receives the same DEPLOY_* values shell hooks get as
+// environment variables.
+type HookFunc func(env map[string]string) error
+
+/*
+ *
+ *	Hooks declares the shell commands to run at each lifecycle point; it
+ *	mirrors the "hooks" block in deploy.json. Func carries Go callbacks
+ *	registered through DeployWithHooks and isn't JSON-configurable.
+ *
+ *	PreZip, PreUpload, PostZip and PostUpload only run when uploadArchive
+ *	actually zips and uploads an archive. When BuildKey already exists in
+ *	Storage (the idempotency skip described on uploadArchive in deploy.go),
+ *	none of the four fire — there's no zip or upload for them to wrap.
+ *
+ */
+
+type Hooks struct {
+	PreZip    []string `json:"preZip"`
+	PreUpload []string `json:"preUpload"`
+
+	// PostZip and PostUpload both run after uploadArchive's single
+	// zip-and-upload stream finishes: the zip is written straight into the
+	// upload (see uploadArchive in deploy.go), so there's no point in the
+	// pipeline where the archive exists but hasn't been uploaded yet.
+	// PostZip can't inspect the archive pre-upload; it's kept as a distinct
+	// hook point only so deploy.json's existing naming keeps working.
+	PostZip    []string `json:"postZip"`
+	PostUpload []string `json:"postUpload"`
+
+	PreDeploy  []string `json:"preDeploy"`
+	PostDeploy []string `json:"postDeploy"`
+	OnFailure  []string `json:"onFailure"`
+
+	Func map[HookPoint][]HookFunc `json:"-"`
+}
+
+func (descriptor *_deploymentDescriptor) hookEnv() map[string]string {
+	bucket := descriptor.Storage.S3.Bucket
+	if bucket == "" {
+		bucket = descriptor.AWS.S3.Bucket
+	}
+
+	return map[string]string{
+		"DEPLOY_BUILD_VERSION": descriptor.BuildVersion,
+		"DEPLOY_COMMIT":        descriptor.CommitHash,
+		"DEPLOY_BUCKET":        bucket,
+		"DEPLOY_KEY":           descriptor.BuildKey,
+	}
+}
+
+// runHooks runs every Go callback and shell command registered at point, in
+// order, stopping at the first error so the caller can short-circuit the
+// pipeline.
+func (descriptor *_deploymentDescriptor) runHooks(point HookPoint, commands []string) error {
+	env := descriptor.hookEnv()
+
+	for _, fn := range descriptor.Hooks.Func[point] {
+		if err := fn(env); err != nil {
+			return err
+		}
+	}
+
+	for _, command := range commands {
+		if err := runShellHook(command, env); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func runShellHook(command string, env map[string]string) error {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	cmd.Env = os.Environ()
+	for key, value := range env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+
+	return cmd.Run()
+}
+
+// runFailureHook runs the onFailure hooks and returns cause, so callers can
+// `return descriptor.runFailureHook(err)` from any pipeline failure.
+func (descriptor *_deploymentDescriptor) runFailureHook(cause error) error {
+	if hookErr := descriptor.runHooks(HookOnFailure, descriptor.Hooks.OnFailure); hookErr != nil {
+		return fmt.Errorf("%v (onFailure hook also failed: %v)", cause, hookErr)
+	}
+
+	return cause
+}
@@ -0,0 +1,105 @@
+package deploy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+)
+
+/*
+ *
+ *	ignoreMatcher applies a small, glob-based subset of gitignore syntax:
+ *	one pattern per line, "#" comments and "!" negation. A trailing "/" is
+ *	accepted but dropped, so such a pattern matches files as well as
+ *	directories of that name. It's loaded from .ebignore,
+ *	falling back to .gitignore, matching Elastic Beanstalk's own CLI.
+ *
+ */
+
+type ignoreMatcher struct {
+	patterns []ignorePattern
+}
+
+type ignorePattern struct {
+	glob   string
+	negate bool
+}
+
+// loadIgnoreMatcher reads .ebignore, or .gitignore if no .ebignore exists,
+// from deployDir. Neither file existing is not an error: it just means
+// nothing is ignored.
+func loadIgnoreMatcher(deployDir string) (*ignoreMatcher, error) {
+	for _, name := range []string{".ebignore", ".gitignore"} {
+		content, err := ioutil.ReadFile(filepath.Join(deployDir, name))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		return parseIgnoreFile(content), nil
+	}
+
+	return &ignoreMatcher{}, nil
+}
+
+func parseIgnoreFile(content []byte) *ignoreMatcher {
+	matcher := &ignoreMatcher{}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		pattern := ignorePattern{}
+
+		if strings.HasPrefix(line, "!") {
+			pattern.negate = true
+			line = line[1:]
+		}
+
+		line = strings.TrimSuffix(line, "/")
+		line = strings.TrimPrefix(line, "/")
+
+		if !strings.Contains(line, "/") {
+			line = "**/" + line
+		}
+
+		pattern.glob = line
+
+		matcher.patterns = append(matcher.patterns, pattern)
+	}
+
+	return matcher
+}
+
+// match reports whether relativePath (relative to the deployment directory)
+// is ignored. Later patterns win, so a "!" re-include after a broad ignore
+// works the way gitignore users expect.
+func (matcher *ignoreMatcher) match(relativePath string) bool {
+	if matcher == nil {
+		return false
+	}
+
+	relativePath = filepath.ToSlash(relativePath)
+
+	ignored := false
+	for _, pattern := range matcher.patterns {
+		matched, _ := doublestar.Match(pattern.glob, relativePath)
+		if !matched {
+			matched, _ = doublestar.Match(pattern.glob+"/**", relativePath)
+		}
+
+		if matched {
+			ignored = !pattern.negate
+		}
+	}
+
+	return ignored
+}
@@ -0,0 +1,168 @@
+package deploy
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elasticbeanstalk"
+)
+
+// defaultDeployTimeout applies when deploy.json leaves deployTimeoutSeconds
+// unset or zero.
+const (
+	defaultDeployTimeout = 15 * time.Minute
+	environmentPollEvery = 10 * time.Second
+)
+
+// EventHandler is called with every new ELB event seen while
+// waitForEnvironmentReady polls a rolling-out environment.
+type EventHandler func(*elasticbeanstalk.EventDescription)
+
+/*
+ *
+ *	waitForEnvironmentReady polls DescribeEnvironments and DescribeEvents
+ *	until the environment is healthy and running descriptor.BuildVersion,
+ *	streaming events to descriptor.EventHandler as they arrive. Success
+ *	requires the version label to match what was just deployed, so a stale
+ *	healthy environment caught in the gap before UpdateEnvironment's
+ *	asynchronous effects land can't pass; a non-Updating environment that
+ *	still doesn't match is only treated as a failed rollout (rather than
+ *	just not started yet) once Updating has actually been observed. If the
+ *	environment ends up unhealthy, or DeployTimeout elapses first, it rolls
+ *	back to previousVersion and returns an error describing what went
+ *	wrong.
+ *
+ */
+
+func (descriptor *_deploymentDescriptor) waitForEnvironmentReady(elbclient *elasticbeanstalk.ElasticBeanstalk, previousVersion string) error {
+	deadline := time.Now().Add(descriptor.DeployTimeout)
+
+	var since time.Time
+	var errorEvents []string
+	var sawUpdating bool
+
+	for {
+		events, newSince, err := descriptor.pollNewEvents(elbclient, since)
+		if err != nil {
+			return err
+		}
+		since = newSince
+
+		for _, event := range events {
+			if descriptor.EventHandler != nil {
+				descriptor.EventHandler(event)
+			}
+
+			switch aws.StringValue(event.Severity) {
+			case elasticbeanstalk.EventSeverityError, elasticbeanstalk.EventSeverityFatal:
+				errorEvents = append(errorEvents, aws.StringValue(event.Message))
+			}
+		}
+
+		output, err := elbclient.DescribeEnvironments(&elasticbeanstalk.DescribeEnvironmentsInput{
+			EnvironmentNames: []*string{aws.String(descriptor.AWS.ELB.EnvironmentName)},
+		})
+		if err != nil {
+			return err
+		}
+
+		if len(output.Environments) == 0 {
+			return fmt.Errorf("environment %q not found", descriptor.AWS.ELB.EnvironmentName)
+		}
+
+		env := output.Environments[0]
+
+		if aws.StringValue(env.Status) == elasticbeanstalk.EnvironmentStatusUpdating {
+			sawUpdating = true
+		} else {
+			ready := environmentIsHealthy(env) && aws.StringValue(env.VersionLabel) == descriptor.BuildVersion
+			if ready {
+				return nil
+			}
+
+			// Only treat "not Updating, not ready" as a finished-but-failed
+			// rollout once Updating has actually been observed: an update
+			// that begins and completes between two polls still needs to
+			// be accepted above, but one that never got this far yet (the
+			// environment hasn't picked up UpdateEnvironment) just needs
+			// more time, not a rollback.
+			if sawUpdating {
+				return descriptor.rollback(elbclient, previousVersion, errorEvents)
+			}
+		}
+
+		if time.Now().After(deadline) {
+			errorEvents = append(errorEvents, fmt.Sprintf("environment did not become ready within %s", descriptor.DeployTimeout))
+			return descriptor.rollback(elbclient, previousVersion, errorEvents)
+		}
+
+		time.Sleep(environmentPollEvery)
+	}
+}
+
+func environmentIsHealthy(env *elasticbeanstalk.EnvironmentDescription) bool {
+	switch aws.StringValue(env.Health) {
+	case elasticbeanstalk.EnvironmentHealthRed:
+		return false
+	}
+
+	switch aws.StringValue(env.HealthStatus) {
+	case "Severe", "Degraded":
+		return false
+	}
+
+	return true
+}
+
+// pollNewEvents fetches the events that occurred after since and returns
+// them oldest-first, along with the timestamp to pass as since on the next
+// call.
+func (descriptor *_deploymentDescriptor) pollNewEvents(elbclient *elasticbeanstalk.ElasticBeanstalk, since time.Time) ([]*elasticbeanstalk.EventDescription, time.Time, error) {
+	input := &elasticbeanstalk.DescribeEventsInput{
+		EnvironmentName: aws.String(descriptor.AWS.ELB.EnvironmentName),
+	}
+
+	if !since.IsZero() {
+		input.StartTime = aws.Time(since.Add(time.Nanosecond))
+	}
+
+	output, err := elbclient.DescribeEvents(input)
+	if err != nil {
+		return nil, since, err
+	}
+
+	events := output.Events
+
+	// DescribeEvents returns newest-first; reverse so handlers see them in
+	// the order they actually happened.
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+
+	newSince := since
+	for _, event := range events {
+		if event.EventDate != nil && event.EventDate.After(newSince) {
+			newSince = *event.EventDate
+		}
+	}
+
+	return events, newSince, nil
+}
+
+// rollback re-points the environment at previousVersion and returns an error
+// summarizing why the new version was rejected.
+func (descriptor *_deploymentDescriptor) rollback(elbclient *elasticbeanstalk.ElasticBeanstalk, previousVersion string, errorEvents []string) error {
+	if previousVersion != "" && previousVersion != descriptor.BuildVersion {
+		_, err := elbclient.UpdateEnvironment(&elasticbeanstalk.UpdateEnvironmentInput{
+			EnvironmentName: aws.String(descriptor.AWS.ELB.EnvironmentName),
+			VersionLabel:    aws.String(previousVersion),
+		})
+		if err != nil {
+			errorEvents = append(errorEvents, fmt.Sprintf("rollback to %q failed: %v", previousVersion, err))
+		}
+	}
+
+	return fmt.Errorf("deployment of %s failed to become healthy: %s", descriptor.BuildVersion, strings.Join(errorEvents, "; "))
+}
@@ -0,0 +1,308 @@
+package deploy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	gcs "cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/minio/minio-go/v7"
+	miniocredentials "github.com/minio/minio-go/v7/pkg/credentials"
+	"google.golang.org/api/option"
+)
+
+/*
+ *
+ *	Storage is the artifact storage backend a deployment archive is put
+ *	into before elasticBeanstalkDeploy picks it up. Implementations back
+ *	onto S3, the local filesystem, a MinIO (or other S3-compatible)
+ *	endpoint, or Google Cloud Storage.
+ *
+ */
+
+type Storage interface {
+	Put(key string, r io.Reader, size int64) error
+
+	// Exists reports whether key already holds a complete object. Since
+	// uploadArchive streams the zip straight into Put without ever knowing
+	// its size up front, implementations can't compare against an expected
+	// size/ETag; they settle for rejecting obviously-truncated objects
+	// (zero length), which is a weaker guarantee than full integrity
+	// verification. A non-empty object under key is treated as the real
+	// thing: a same-named object of the right length but different content
+	// (built from a different commit, for instance) still causes
+	// uploadArchive to skip the upload. Set ForceRepublish to bypass the
+	// skip entirely when that matters.
+	Exists(key string) (bool, error)
+}
+
+/*
+ *
+ *	StorageConfig mirrors the "storage" block in deploy.json: Driver picks
+ *	the backend, the remaining fields carry driver-specific settings.
+ *
+ */
+
+type StorageConfig struct {
+	Driver string `json:"driver"`
+	S3     struct {
+		Bucket string `json:"bucket"`
+	} `json:"s3"`
+	Local struct {
+		Path string `json:"path"`
+	} `json:"local"`
+	MinIO struct {
+		Endpoint        string `json:"endpoint"`
+		Bucket          string `json:"bucket"`
+		AccessKey       string `json:"accessKey"`
+		SecretAccessKey string `json:"secretAccessKey"`
+		UseSSL          bool   `json:"useSSL"`
+	} `json:"minio"`
+	GCS struct {
+		Bucket          string `json:"bucket"`
+		CredentialsFile string `json:"credentialsFile"`
+	} `json:"gcs"`
+}
+
+// newStorage builds the Storage backend selected by descriptor.Storage.Driver.
+// An empty driver name defaults to "s3" so existing deploy.json files, which
+// predate the storage block, keep working unchanged.
+func (descriptor *_deploymentDescriptor) newStorage() (Storage, error) {
+	switch descriptor.Storage.Driver {
+	case "", "s3":
+		bucket := descriptor.Storage.S3.Bucket
+		if bucket == "" {
+			bucket = descriptor.AWS.S3.Bucket
+		}
+
+		return &S3Storage{descriptor: descriptor, bucket: bucket}, nil
+	case "local":
+		return &LocalStorage{basePath: descriptor.Storage.Local.Path}, nil
+	case "minio":
+		return newMinIOStorage(descriptor.Storage.MinIO)
+	case "gcs":
+		return newGCSStorage(descriptor.Storage.GCS)
+	default:
+		return nil, fmt.Errorf("unknown storage driver %q", descriptor.Storage.Driver)
+	}
+}
+
+/*
+ *
+ *	S3Storage, the default backend, streams the archive to S3 through the
+ *	s3manager multipart uploader, tuned by the descriptor's UploadOptions.
+ *
+ */
+
+type S3Storage struct {
+	descriptor *_deploymentDescriptor
+	bucket     string
+}
+
+func (storage *S3Storage) Put(key string, r io.Reader, size int64) error {
+	s3client := s3.New(storage.descriptor.Session)
+	s3client.Handlers.Build.PushBack(setUploadPartContentMD5)
+
+	partSize := storage.descriptor.Upload.PartSize
+	if partSize <= 0 {
+		partSize = defaultUploadPartSize
+	}
+
+	concurrency := storage.descriptor.Upload.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultUploadConcurrency
+	}
+
+	uploader := s3manager.NewUploaderWithClient(s3client, func(u *s3manager.Uploader) {
+		u.PartSize = partSize
+		u.Concurrency = concurrency
+		u.LeavePartsOnError = storage.descriptor.Upload.LeavePartsOnError
+	})
+
+	_, err := uploader.Upload(&s3manager.UploadInput{
+		Bucket:      aws.String(storage.bucket),
+		Key:         aws.String(key),
+		ACL:         aws.String("private"),
+		Body:        r,
+		ContentType: aws.String("application/zip"),
+	})
+
+	return err
+}
+
+func (storage *S3Storage) Exists(key string) (bool, error) {
+	s3client := s3.New(storage.descriptor.Session)
+
+	output, err := s3client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(storage.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && (aerr.Code() == s3.ErrCodeNoSuchKey || aerr.Code() == "NotFound") {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return aws.Int64Value(output.ContentLength) > 0, nil
+}
+
+/*
+ *
+ *	LocalStorage stages the archive on a shared filesystem, for deploys
+ *	that need the bundle kept around for auditing rather than shipped
+ *	straight to S3.
+ *
+ */
+
+type LocalStorage struct {
+	basePath string
+}
+
+func (storage *LocalStorage) Put(key string, r io.Reader, size int64) error {
+	fullPath := filepath.Join(storage.basePath, key)
+
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0o755); err != nil {
+		return err
+	}
+
+	file, err := os.Create(fullPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	_, err = io.Copy(file, r)
+	return err
+}
+
+func (storage *LocalStorage) Exists(key string) (bool, error) {
+	info, err := os.Stat(filepath.Join(storage.basePath, key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return info.Size() > 0, nil
+}
+
+/*
+ *
+ *	MinIOStorage targets a MinIO (or other S3-compatible) endpoint, for
+ *	on-prem CI that can't reach AWS S3.
+ *
+ */
+
+type MinIOStorage struct {
+	client *minio.Client
+	bucket string
+}
+
+func newMinIOStorage(cfg struct {
+	Endpoint        string `json:"endpoint"`
+	Bucket          string `json:"bucket"`
+	AccessKey       string `json:"accessKey"`
+	SecretAccessKey string `json:"secretAccessKey"`
+	UseSSL          bool   `json:"useSSL"`
+}) (*MinIOStorage, error) {
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  miniocredentials.NewStaticV4(cfg.AccessKey, cfg.SecretAccessKey, ""),
+		Secure: cfg.UseSSL,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &MinIOStorage{client: client, bucket: cfg.Bucket}, nil
+}
+
+func (storage *MinIOStorage) Put(key string, r io.Reader, size int64) error {
+	_, err := storage.client.PutObject(context.Background(), storage.bucket, key, r, size, minio.PutObjectOptions{
+		ContentType: "application/zip",
+	})
+
+	return err
+}
+
+func (storage *MinIOStorage) Exists(key string) (bool, error) {
+	info, err := storage.client.StatObject(context.Background(), storage.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return info.Size > 0, nil
+}
+
+/*
+ *
+ *	GCSStorage targets a Google Cloud Storage bucket.
+ *
+ */
+
+type GCSStorage struct {
+	bucket *gcs.BucketHandle
+}
+
+func newGCSStorage(cfg struct {
+	Bucket          string `json:"bucket"`
+	CredentialsFile string `json:"credentialsFile"`
+}) (*GCSStorage, error) {
+	ctx := context.Background()
+
+	var opts []option.ClientOption
+	if cfg.CredentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(cfg.CredentialsFile))
+	}
+
+	client, err := gcs.NewClient(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GCSStorage{bucket: client.Bucket(cfg.Bucket)}, nil
+}
+
+func (storage *GCSStorage) Put(key string, r io.Reader, size int64) error {
+	ctx := context.Background()
+	w := storage.bucket.Object(key).NewWriter(ctx)
+	w.ContentType = "application/zip"
+
+	if _, err := io.Copy(w, r); err != nil {
+		_ = w.Close()
+		return err
+	}
+
+	return w.Close()
+}
+
+func (storage *GCSStorage) Exists(key string) (bool, error) {
+	ctx := context.Background()
+
+	attrs, err := storage.bucket.Object(key).Attrs(ctx)
+	if err != nil {
+		if errors.Is(err, gcs.ErrObjectNotExist) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return attrs.Size > 0, nil
+}